@@ -1,15 +1,14 @@
 package consul
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"strconv"
 	"sync"
 	"time"
 
 	"github.com/dffrntmedia/consul-lb-gce/registry"
 
-	"github.com/golang/glog"
 	consul "github.com/hashicorp/consul/api"
 )
 
@@ -21,14 +20,46 @@ const (
 var (
 	// ErrNoAddress when no Consul address has been specified
 	ErrNoAddress = errors.New("No Consul address specified")
+
+	// ErrNodeMetaUnsupportedByPlanWatcher is returned when Config.NodeMeta
+	// is set alongside WatcherKindPlan: hashicorp/consul/api/watch's
+	// "services"/"service" watch types don't accept a node_meta filter,
+	// so honoring NodeMeta there would mean silently watching and exposing
+	// every node instead.
+	ErrNodeMetaUnsupportedByPlanWatcher = errors.New("consul: NodeMeta filtering is not supported by WatcherKindPlan")
+
+	// ErrConnectUnsupportedByPlanWatcher is returned when Config.Connect is
+	// set alongside WatcherKindPlan: hashicorp/consul/api/watch's "service"
+	// watch type has no "connect" parameter, so watch.Parse silently drops
+	// it and the plan falls back to watching plain app instances instead of
+	// Connect sidecar proxies.
+	ErrConnectUnsupportedByPlanWatcher = errors.New("consul: Connect is not supported by WatcherKindPlan")
 )
 
 // consulRegistry is a registry for local caching and further watching of Consul data.
 type consulRegistry struct {
 	client *consul.Client
 	sync.RWMutex
-	watchedServices map[string]*consulService
+	watchedServices map[serviceKey]*consulService
 	tagsToWatch     []string
+	nodeMeta        map[string]string
+
+	allowStale      bool
+	datacenter      string
+	refreshInterval time.Duration
+	connect         bool
+	tagSep          string
+	relabelConfigs  []compiledRelabelConfig
+
+	watcher watcher
+}
+
+// serviceKey identifies a watched service together with the tag that made
+// us watch it, so a service exposing several watched tags is tracked (and
+// reported upstream) once per tag instead of once overall.
+type serviceKey struct {
+	name string
+	tag  string
 }
 
 // consulService contains data belonging to the same service.
@@ -41,42 +72,87 @@ type consulService struct {
 	tag       string
 }
 
-// NewRegistry returns a Consul-backed service registry
+// NewRegistry returns a Consul-backed service registry. A single address
+// yields a plain consulRegistry; several addresses yield a federatedRegistry
+// that watches each one independently and merges their updates.
 func NewRegistry(config *registry.Config) (registry.Registry, error) {
 	// validate arguments
 	if len(config.Addresses) < 1 {
 		return nil, ErrNoAddress
 	}
+	if len(config.Addresses) == 1 {
+		return newConsulRegistry(config.Addresses[0], datacenterFor(config, 0), config)
+	}
+	return newFederatedRegistry(config)
+}
+
+// datacenterFor returns the datacenter that should be targeted for
+// config.Addresses[i]: the matching entry in config.Datacenters if one was
+// given, otherwise the single config.Datacenter applied to every address.
+func datacenterFor(config *registry.Config, i int) string {
+	if i < len(config.Datacenters) && config.Datacenters[i] != "" {
+		return config.Datacenters[i]
+	}
+	return config.Datacenter
+}
+
+// newConsulRegistry builds a consulRegistry talking to a single Consul
+// agent at address, optionally pinned to datacenter.
+func newConsulRegistry(address, datacenter string, config *registry.Config) (*consulRegistry, error) {
+	if config.WatcherKind == registry.WatcherKindPlan && len(config.NodeMeta) > 0 {
+		return nil, ErrNodeMetaUnsupportedByPlanWatcher
+	}
+	if config.WatcherKind == registry.WatcherKindPlan && config.Connect {
+		return nil, ErrConnectUnsupportedByPlanWatcher
+	}
 
 	// connect to Consul
 	clientConfig := consul.DefaultConfig()
-	// select first address alone
-	clientConfig.Address = config.Addresses[0]
+	clientConfig.Address = address
+	if datacenter != "" {
+		clientConfig.Datacenter = datacenter
+	}
+	if config.Token != "" {
+		clientConfig.Token = config.Token
+	}
+	// Connect deployments universally require ACLs and TLS.
+	clientConfig.TLSConfig.CAFile = config.CAFile
+	clientConfig.TLSConfig.CertFile = config.CertFile
+	clientConfig.TLSConfig.KeyFile = config.KeyFile
 	client, err := consul.NewClient(clientConfig)
 	if err != nil {
 		return nil, err
 	}
 
 	// prepare registry
-	return &consulRegistry{
+	cr := &consulRegistry{
 		client:          client,
-		watchedServices: make(map[string]*consulService),
+		watchedServices: make(map[serviceKey]*consulService),
 		tagsToWatch:     config.TagsToWatch,
-	}, nil
+		nodeMeta:        config.NodeMeta,
+		allowStale:      config.AllowStale,
+		datacenter:      datacenter,
+		refreshInterval: config.RefreshInterval,
+		connect:         config.Connect,
+		tagSep:          config.TagSeparator,
+		relabelConfigs:  compileRelabelConfigs(config.RelabelConfigs),
+	}
+	cr.watcher = newWatcher(config.WatcherKind, cr)
+	return cr, nil
 }
 
-func (cr *consulRegistry) Run(upstream chan<- *registry.ServiceUpdate, done <-chan struct{}) {
+func (cr *consulRegistry) Run(ctx context.Context, upstream chan<- *registry.ServiceUpdate) {
 	defer close(upstream)
 	// stop all service watchers
 	defer cr.stop()
 
 	// internal update channel
 	update := make(chan *consulService, 16)
-	go cr.watchServices(update, done)
+	go cr.watcher.watchServices(ctx, update)
 
 	for {
 		select {
-		case <-done: // quit
+		case <-ctx.Done(): // quit
 			return
 		case srv := <-update:
 			// was it removed?
@@ -84,22 +160,32 @@ func (cr *consulRegistry) Run(upstream chan<- *registry.ServiceUpdate, done <-ch
 				close(srv.done)
 
 				// send clearing update upstream.
-				upstream <- &registry.ServiceUpdate{
+				select {
+				case upstream <- &registry.ServiceUpdate{
 					ServiceName: srv.Name,
 					UpdateType:  registry.DELETED,
 					Tag:         srv.tag,
+					Datacenter:  cr.datacenter,
+				}:
+				case <-ctx.Done():
+					return
 				}
 				break
 			}
 			// it wasn't removed, so launch watcher for service
 			// but only if it wasn't running in the first place
 			if !srv.running {
-				go cr.watchService(srv, upstream)
+				go cr.watcher.watchService(ctx, srv, upstream)
 				srv.running = true
-				upstream <- &registry.ServiceUpdate{
+				select {
+				case upstream <- &registry.ServiceUpdate{
 					ServiceName: srv.Name,
 					UpdateType:  registry.NEW,
 					Tag:         srv.tag,
+					Datacenter:  cr.datacenter,
+				}:
+				case <-ctx.Done():
+					return
 				}
 			}
 		}
@@ -117,134 +203,37 @@ func (cr *consulRegistry) stop() {
 	}
 }
 
-// watchServices retrieves updates from Consul's services endpoint and sends
-// potential updates to the update channel.
-func (cr *consulRegistry) watchServices(update chan<- *consulService, done <-chan struct{}) {
-	var lastIndex uint64
-	for {
-		// ask Consul about services
-		catalog := cr.client.Catalog()
-		services, meta, err := catalog.Services(&consul.QueryOptions{
-			// is we have previously asked, then we should behave and wait for changes
-			WaitIndex: lastIndex,
-			WaitTime:  consulWatchTimeout,
-		})
-		if err != nil {
-			glog.Errorf("Error refreshing service list: %s", err)
-			// failure here is not catastrophic, so retry
-			time.Sleep(consulRetryInterval)
-			continue
-		}
-		// if the index equals the previous one, the watch timed out with no update.
-		if meta.LastIndex == lastIndex {
-			continue
-		}
-		lastIndex = meta.LastIndex
-
-		cr.Lock()
-		select {
-		case <-done: // app is terminating, die
-			cr.Unlock()
-			return
-		default:
-			// continue
-		}
-		// check for services not yet cached locally.
-		for k, v := range services {
-			// ignore all but the ones with specified tags
-			ignore := true
-
-			var properTag string
-
-			// iterate service tags
-			for _, tag := range v {
-				// iterate possible tags and compare
-				for _, tagToWatch := range cr.tagsToWatch {
-					if tag == tagToWatch {
-						ignore = false
-						properTag = tag
-						// TODO add tag to watchedService
-					}
-				}
-			}
-			// have any of the tags to be watched been found?
-			if ignore {
-				continue
-			}
-
-			// is it a new service?
-			service, ok := cr.watchedServices[k]
-			if !ok { // yes
-				service = new(consulService)
-				service.Name = k
-				service.done = make(chan struct{})
-				service.tag = properTag
-				cr.watchedServices[k] = service
-				// since src.running == false, registry will start watching this service
-				// before sending updates upstream
-				update <- service
-			}
-
-		}
-		// check for deleted services we should remove from cache
-		for name, srv := range cr.watchedServices {
-			if _, ok := services[name]; !ok {
-				srv.removed = true
-				// watchService will take care of sending this upstream
-				update <- srv
-				delete(cr.watchedServices, name)
-			}
-		}
-		cr.Unlock()
-	}
+// queryOptions builds the QueryOptions shared by every blocking query this
+// registry issues, layering the given wait index on top of the
+// AllowStale/Datacenter/NodeMeta settings from the registry's Config.
+// It's bound to ctx so that canceling ctx aborts an in-flight long-poll
+// immediately instead of waiting out consulWatchTimeout.
+func (cr *consulRegistry) queryOptions(ctx context.Context, waitIndex uint64) *consul.QueryOptions {
+	return (&consul.QueryOptions{
+		WaitIndex:  waitIndex,
+		WaitTime:   consulWatchTimeout,
+		AllowStale: cr.allowStale,
+		Datacenter: cr.datacenter,
+		NodeMeta:   cr.nodeMeta,
+	}).WithContext(ctx)
 }
 
-// watchService retrieves updates about a service from Consul's service endpoint.
-// On a potential update, all service instances are pushed upstream.
-func (cr *consulRegistry) watchService(service *consulService, upstream chan<- *registry.ServiceUpdate) {
-	catalog := cr.client.Catalog()
-	for {
-		nodes, meta, err := catalog.Service(service.Name, "", &consul.QueryOptions{
-			WaitIndex: service.lastIndex,
-			WaitTime:  consulWatchTimeout,
-		})
-		if err != nil {
-			glog.Errorf("Error refreshing service %s: %s", service.Name, err)
-			time.Sleep(consulRetryInterval)
-			continue
-		}
-		// If the index equals the previous one, the watch timed out with no update.
-		if meta.LastIndex == service.lastIndex {
-			continue
-		}
-		service.lastIndex = meta.LastIndex
-		service.Instances = make(map[string]*registry.ServiceInstance, len(nodes))
-
-		for _, node := range nodes {
-			service.Instances[fmt.Sprintf("%s:%d", node.ServiceAddress, node.ServicePort)] = &registry.ServiceInstance{
-				Host:    node.Node,
-				Address: node.Address,
-				Tags:    node.ServiceTags,
-				Port:    strconv.Itoa(node.ServicePort),
-			}
-		}
-
-		cr.Lock()
-		select {
-		case <-service.done:
-			cr.Unlock()
-			return
-		default:
-			// continue
-		}
+// serviceTagFilter builds a Consul filter expression selecting services
+// carrying the given tag, for use as QueryOptions.Filter with Catalog().Services.
+func serviceTagFilter(tag string) string {
+	return fmt.Sprintf("ServiceTags contains %q", tag)
+}
 
-		// tell upstream about the updates
-		upstream <- &registry.ServiceUpdate{
-			ServiceName:      service.Name,
-			UpdateType:       registry.CHANGED,
-			ServiceInstances: service.Instances,
-			Tag:              service.tag,
-		}
-		cr.Unlock()
+// throttle sleeps out the remainder of RefreshInterval, if any, after a
+// watch iteration that took `elapsed`. Consul watches a large catalog
+// constantly churn the raft index, so without this a long-poll that returns
+// immediately would hammer the agent in a tight loop.
+func (cr *consulRegistry) throttle(elapsed time.Duration) {
+	if cr.refreshInterval <= 0 {
+		return
+	}
+	if wait := cr.refreshInterval - elapsed; wait > 0 {
+		time.Sleep(wait)
 	}
 }
+
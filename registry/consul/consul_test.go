@@ -0,0 +1,40 @@
+package consul
+
+import (
+	"testing"
+
+	"github.com/dffrntmedia/consul-lb-gce/registry"
+)
+
+func TestNewConsulRegistryRejectsNodeMetaWithPlanWatcher(t *testing.T) {
+	_, err := newConsulRegistry("127.0.0.1:8500", "", &registry.Config{
+		WatcherKind: registry.WatcherKindPlan,
+		NodeMeta:    map[string]string{"rack": "a"},
+	})
+	if err != ErrNodeMetaUnsupportedByPlanWatcher {
+		t.Errorf("newConsulRegistry() error = %v, want %v", err, ErrNodeMetaUnsupportedByPlanWatcher)
+	}
+}
+
+func TestNewConsulRegistryRejectsConnectWithPlanWatcher(t *testing.T) {
+	_, err := newConsulRegistry("127.0.0.1:8500", "", &registry.Config{
+		WatcherKind: registry.WatcherKindPlan,
+		Connect:     true,
+	})
+	if err != ErrConnectUnsupportedByPlanWatcher {
+		t.Errorf("newConsulRegistry() error = %v, want %v", err, ErrConnectUnsupportedByPlanWatcher)
+	}
+}
+
+func TestNewConsulRegistryAllowsConnectWithLongPollWatcher(t *testing.T) {
+	cr, err := newConsulRegistry("127.0.0.1:8500", "", &registry.Config{
+		WatcherKind: registry.WatcherKindLongPoll,
+		Connect:     true,
+	})
+	if err != nil {
+		t.Fatalf("newConsulRegistry() error = %v, want nil", err)
+	}
+	if !cr.connect {
+		t.Error("newConsulRegistry() cr.connect = false, want true")
+	}
+}
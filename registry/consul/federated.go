@@ -0,0 +1,58 @@
+package consul
+
+import (
+	"context"
+	"sync"
+
+	"github.com/dffrntmedia/consul-lb-gce/registry"
+)
+
+// federatedRegistry fans the ServiceUpdate streams of several per-datacenter
+// consulRegistry instances into a single upstream channel, so a GCE backend
+// can be built from services spread across a pool of Consul clusters. Each
+// member registry owns its own independent watchedServices map keyed by
+// serviceKey{name, tag} (no datacenter component), so the same service name
+// appearing in several datacenters is tracked, and reported upstream, once
+// per datacenter rather than being silently collapsed into one.
+type federatedRegistry struct {
+	registries []*consulRegistry
+}
+
+// newFederatedRegistry builds one consulRegistry per address in
+// config.Addresses, each optionally pinned to its own datacenter.
+func newFederatedRegistry(config *registry.Config) (registry.Registry, error) {
+	fr := &federatedRegistry{}
+	for i, address := range config.Addresses {
+		cr, err := newConsulRegistry(address, datacenterFor(config, i), config)
+		if err != nil {
+			return nil, err
+		}
+		fr.registries = append(fr.registries, cr)
+	}
+	return fr, nil
+}
+
+func (fr *federatedRegistry) Run(ctx context.Context, upstream chan<- *registry.ServiceUpdate) {
+	defer close(upstream)
+
+	var wg sync.WaitGroup
+	for _, cr := range fr.registries {
+		wg.Add(1)
+		go func(cr *consulRegistry) {
+			defer wg.Done()
+			// Each datacenter is watched independently: one falling over
+			// (network partition, agent restart) must not stop updates
+			// from the others.
+			dcUpstream := make(chan *registry.ServiceUpdate)
+			go cr.Run(ctx, dcUpstream)
+			for update := range dcUpstream {
+				select {
+				case upstream <- update:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(cr)
+	}
+	wg.Wait()
+}
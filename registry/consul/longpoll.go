@@ -0,0 +1,233 @@
+package consul
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dffrntmedia/consul-lb-gce/registry"
+
+	"github.com/golang/glog"
+	consul "github.com/hashicorp/consul/api"
+)
+
+// longPollWatcher is the original watcher backend: a hand-rolled loop of
+// blocking Consul queries. It's always available and needs nothing beyond
+// the standard Consul HTTP API.
+type longPollWatcher struct {
+	cr *consulRegistry
+}
+
+// watchServices retrieves updates from Consul's services endpoint and sends
+// potential updates to the update channel. Filtering by NodeMeta and, when
+// configured, by tag happens server-side in Consul rather than in-process,
+// so a single long-poll per tag is all it costs us regardless of how many
+// services or tags exist in the catalog.
+func (w *longPollWatcher) watchServices(ctx context.Context, update chan<- *consulService) {
+	cr := w.cr
+	if len(cr.tagsToWatch) == 0 {
+		// no tags configured: watch every service visible under NodeMeta,
+		// untagged.
+		w.watchServiceSet(ctx, update, "", func(opts *consul.QueryOptions) (map[string][]string, *consul.QueryMeta, error) {
+			return cr.client.Catalog().Services(opts)
+		})
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, tag := range cr.tagsToWatch {
+		wg.Add(1)
+		go func(tag string) {
+			defer wg.Done()
+			w.watchServiceSet(ctx, update, tag, func(opts *consul.QueryOptions) (map[string][]string, *consul.QueryMeta, error) {
+				opts.Filter = serviceTagFilter(tag)
+				return cr.client.Catalog().Services(opts)
+			})
+		}(tag)
+	}
+	wg.Wait()
+}
+
+// watchServiceSet long-polls a single server-side filtered view of the
+// catalog (either "everything", or "everything tagged `tag`") and reconciles
+// it against the subset of cr.watchedServices keyed with that tag.
+func (w *longPollWatcher) watchServiceSet(
+	ctx context.Context,
+	update chan<- *consulService,
+	tag string,
+	query func(*consul.QueryOptions) (map[string][]string, *consul.QueryMeta, error),
+) {
+	cr := w.cr
+	var lastIndex uint64
+	for {
+		start := time.Now()
+		services, meta, err := query(cr.queryOptions(ctx, lastIndex))
+		if err != nil {
+			if ctx.Err() != nil { // app is terminating, die
+				return
+			}
+			glog.Errorf("Error refreshing service list for tag %q: %s", tag, err)
+			// failure here is not catastrophic, so retry
+			time.Sleep(consulRetryInterval)
+			continue
+		}
+		// if the index equals the previous one, the watch timed out with no update.
+		if meta.LastIndex == lastIndex {
+			cr.throttle(time.Since(start))
+			continue
+		}
+		// Consul's index can go backwards after a Raft snapshot restore;
+		// treat that as "start over" rather than waiting forever for an
+		// index we'll never see again.
+		if meta.LastIndex < lastIndex {
+			lastIndex = 0
+		} else {
+			lastIndex = meta.LastIndex
+		}
+
+		cr.Lock()
+		select {
+		case <-ctx.Done(): // app is terminating, die
+			cr.Unlock()
+			return
+		default:
+			// continue
+		}
+		// check for services not yet cached locally.
+		for name := range services {
+			key := serviceKey{name: name, tag: tag}
+			if _, ok := cr.watchedServices[key]; ok {
+				continue
+			}
+			service := new(consulService)
+			service.Name = name
+			service.done = make(chan struct{})
+			service.tag = tag
+			cr.watchedServices[key] = service
+			// since src.running == false, registry will start watching this service
+			// before sending updates upstream
+			select {
+			case update <- service:
+			case <-ctx.Done():
+				cr.Unlock()
+				return
+			}
+		}
+		// check for deleted services we should remove from cache, scoped to
+		// this tag so other watchServiceSet goroutines' entries are untouched.
+		for key, srv := range cr.watchedServices {
+			if key.tag != tag {
+				continue
+			}
+			if _, ok := services[key.name]; !ok {
+				srv.removed = true
+				// Run will take care of sending this upstream
+				select {
+				case update <- srv:
+				case <-ctx.Done():
+					cr.Unlock()
+					return
+				}
+				delete(cr.watchedServices, key)
+			}
+		}
+		cr.Unlock()
+
+		cr.throttle(time.Since(start))
+	}
+}
+
+// watchService retrieves updates about a service from Consul's health
+// endpoint, so that only passing instances are ever pushed upstream as
+// backends. When cr.connect is set, it watches Connect-capable proxies
+// instead, via Health().Connect, so the GCE load balancer targets sidecars
+// rather than raw application ports. On a potential update, all service
+// instances are pushed upstream.
+func (w *longPollWatcher) watchService(ctx context.Context, service *consulService, upstream chan<- *registry.ServiceUpdate) {
+	cr := w.cr
+	health := cr.client.Health()
+	for {
+		start := time.Now()
+		var entries []*consul.ServiceEntry
+		var meta *consul.QueryMeta
+		var err error
+		if cr.connect {
+			entries, meta, err = health.Connect(service.Name, service.tag, true, cr.queryOptions(ctx, service.lastIndex))
+		} else {
+			entries, meta, err = health.Service(service.Name, service.tag, true, cr.queryOptions(ctx, service.lastIndex))
+		}
+		if err != nil {
+			if ctx.Err() != nil { // app is terminating, die
+				return
+			}
+			glog.Errorf("Error refreshing service %s: %s", service.Name, err)
+			time.Sleep(consulRetryInterval)
+			continue
+		}
+		// If the index equals the previous one, the watch timed out with no update.
+		if meta.LastIndex == service.lastIndex {
+			cr.throttle(time.Since(start))
+			continue
+		}
+		// Consul index reset semantics: a lower index means the agent was
+		// restored from a snapshot, so forget what we knew and re-watch
+		// from the beginning rather than blocking on an index that will
+		// never be reached again.
+		if meta.LastIndex < service.lastIndex {
+			service.lastIndex = 0
+		} else {
+			service.lastIndex = meta.LastIndex
+		}
+		service.Instances = make(map[string]*registry.ServiceInstance, len(entries))
+
+		for _, entry := range entries {
+			node := entry.Service
+			instance := &registry.ServiceInstance{
+				Host:    entry.Node.Node,
+				Address: entry.Node.Address,
+				Tags:    node.Tags,
+				Port:    strconv.Itoa(node.Port),
+				Meta:    cr.instanceMeta(entry),
+			}
+			if node.Proxy != nil {
+				instance.ProxyFor = node.Proxy.DestinationServiceName
+			}
+			if cr.relabelDrop(instance.Meta) {
+				continue
+			}
+			service.Instances[fmt.Sprintf("%s:%d", node.Address, node.Port)] = instance
+		}
+
+		cr.Lock()
+		select {
+		case <-service.done:
+			cr.Unlock()
+			return
+		default:
+			// continue
+		}
+
+		// tell upstream about the updates
+		select {
+		case upstream <- &registry.ServiceUpdate{
+			ServiceName:      service.Name,
+			UpdateType:       registry.CHANGED,
+			ServiceInstances: service.Instances,
+			Tag:              service.tag,
+			Datacenter:       cr.datacenter,
+			Meta:             cr.serviceMeta(service),
+		}:
+		case <-ctx.Done():
+			cr.Unlock()
+			return
+		case <-service.done:
+			cr.Unlock()
+			return
+		}
+		cr.Unlock()
+
+		cr.throttle(time.Since(start))
+	}
+}
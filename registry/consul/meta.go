@@ -0,0 +1,110 @@
+package consul
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/dffrntmedia/consul-lb-gce/registry"
+
+	"github.com/golang/glog"
+	consul "github.com/hashicorp/consul/api"
+)
+
+// defaultTagSeparator is used to join ServiceTags into the
+// __meta_consul_tags label when Config.TagSeparator isn't set.
+const defaultTagSeparator = ","
+
+func (cr *consulRegistry) tagSeparator() string {
+	if cr.tagSep != "" {
+		return cr.tagSep
+	}
+	return defaultTagSeparator
+}
+
+// instanceMeta builds the Prometheus-style __meta_consul_* labels for a
+// single health entry, mirroring the consul_sd_config label set: node name,
+// node/service metadata, datacenter and tags.
+func (cr *consulRegistry) instanceMeta(entry *consul.ServiceEntry) map[string]string {
+	sep := cr.tagSeparator()
+	meta := map[string]string{
+		"__meta_consul_node":            entry.Node.Node,
+		"__meta_consul_address":         entry.Node.Address,
+		"__meta_consul_datacenter":      entry.Node.Datacenter,
+		"__meta_consul_service":         entry.Service.Service,
+		"__meta_consul_service_id":      entry.Service.ID,
+		"__meta_consul_service_address": entry.Service.Address,
+		"__meta_consul_tags":            sep + strings.Join(entry.Service.Tags, sep) + sep,
+	}
+	for k, v := range entry.Node.Meta {
+		meta["__meta_consul_metadata_"+k] = v
+	}
+	for k, v := range entry.Service.Meta {
+		meta["__meta_consul_service_metadata_"+k] = v
+	}
+	return meta
+}
+
+// serviceMeta builds the subset of labels shared by every instance of a
+// watched service, for ServiceUpdate.Meta.
+func (cr *consulRegistry) serviceMeta(service *consulService) map[string]string {
+	meta := map[string]string{
+		"__meta_consul_service":    service.Name,
+		"__meta_consul_datacenter": cr.datacenter,
+	}
+	if service.tag != "" {
+		meta["__meta_consul_tag"] = service.tag
+	}
+	return meta
+}
+
+// compiledRelabelConfig is a registry.RelabelConfig with its Regex compiled
+// once up front, rather than on every instance evaluated.
+type compiledRelabelConfig struct {
+	action       registry.RelabelAction
+	sourceLabels []string
+	regex        *regexp.Regexp
+}
+
+// compileRelabelConfigs compiles each config's Regex, logging and skipping
+// (rather than failing registry construction over) any that don't compile.
+func compileRelabelConfigs(configs []registry.RelabelConfig) []compiledRelabelConfig {
+	compiled := make([]compiledRelabelConfig, 0, len(configs))
+	for _, rc := range configs {
+		re, err := regexp.Compile("^(?:" + rc.Regex + ")$")
+		if err != nil {
+			glog.Errorf("Error compiling relabel regex %q: %s", rc.Regex, err)
+			continue
+		}
+		compiled = append(compiled, compiledRelabelConfig{
+			action:       rc.Action,
+			sourceLabels: rc.SourceLabels,
+			regex:        re,
+		})
+	}
+	return compiled
+}
+
+// relabelDrop evaluates cr.relabelConfigs against meta, Prometheus
+// relabel_config keep/drop-style: SourceLabels are looked up in meta, joined
+// with ";", and matched in full against Regex. The instance is dropped if a
+// "keep" rule fails to match or a "drop" rule matches.
+func (cr *consulRegistry) relabelDrop(meta map[string]string) bool {
+	for _, rc := range cr.relabelConfigs {
+		values := make([]string, len(rc.sourceLabels))
+		for i, label := range rc.sourceLabels {
+			values[i] = meta[label]
+		}
+		matched := rc.regex.MatchString(strings.Join(values, ";"))
+		switch rc.action {
+		case registry.RelabelKeep:
+			if !matched {
+				return true
+			}
+		case registry.RelabelDrop:
+			if matched {
+				return true
+			}
+		}
+	}
+	return false
+}
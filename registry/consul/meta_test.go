@@ -0,0 +1,142 @@
+package consul
+
+import (
+	"testing"
+
+	"github.com/dffrntmedia/consul-lb-gce/registry"
+)
+
+func TestRelabelDrop(t *testing.T) {
+	tests := []struct {
+		name    string
+		configs []registry.RelabelConfig
+		meta    map[string]string
+		want    bool
+	}{
+		{
+			name:    "no configs keeps everything",
+			configs: nil,
+			meta:    map[string]string{"__meta_consul_tags": ",prod,"},
+			want:    false,
+		},
+		{
+			name: "keep matching regex is kept",
+			configs: []registry.RelabelConfig{
+				{Action: registry.RelabelKeep, SourceLabels: []string{"__meta_consul_service_metadata_env"}, Regex: "prod"},
+			},
+			meta: map[string]string{"__meta_consul_service_metadata_env": "prod"},
+			want: false,
+		},
+		{
+			name: "keep non-matching regex is dropped",
+			configs: []registry.RelabelConfig{
+				{Action: registry.RelabelKeep, SourceLabels: []string{"__meta_consul_service_metadata_env"}, Regex: "prod"},
+			},
+			meta: map[string]string{"__meta_consul_service_metadata_env": "staging"},
+			want: true,
+		},
+		{
+			name: "keep against a missing label is dropped",
+			configs: []registry.RelabelConfig{
+				{Action: registry.RelabelKeep, SourceLabels: []string{"__meta_consul_service_metadata_env"}, Regex: "prod"},
+			},
+			meta: map[string]string{},
+			want: true,
+		},
+		{
+			name: "drop matching regex is dropped",
+			configs: []registry.RelabelConfig{
+				{Action: registry.RelabelDrop, SourceLabels: []string{"__meta_consul_service_metadata_canary"}, Regex: "true"},
+			},
+			meta: map[string]string{"__meta_consul_service_metadata_canary": "true"},
+			want: true,
+		},
+		{
+			name: "drop non-matching regex is kept",
+			configs: []registry.RelabelConfig{
+				{Action: registry.RelabelDrop, SourceLabels: []string{"__meta_consul_service_metadata_canary"}, Regex: "true"},
+			},
+			meta: map[string]string{"__meta_consul_service_metadata_canary": "false"},
+			want: false,
+		},
+		{
+			name: "multiple source labels are joined with semicolons",
+			configs: []registry.RelabelConfig{
+				{Action: registry.RelabelKeep, SourceLabels: []string{"__meta_consul_service", "__meta_consul_datacenter"}, Regex: "web;us-east-1"},
+			},
+			meta: map[string]string{"__meta_consul_service": "web", "__meta_consul_datacenter": "us-east-1"},
+			want: false,
+		},
+		{
+			name: "regex is anchored so a partial match is not enough",
+			configs: []registry.RelabelConfig{
+				{Action: registry.RelabelKeep, SourceLabels: []string{"__meta_consul_service"}, Regex: "web"},
+			},
+			meta: map[string]string{"__meta_consul_service": "webhooks"},
+			want: true,
+		},
+		{
+			name: "first matching drop rule wins even if a later keep rule would pass",
+			configs: []registry.RelabelConfig{
+				{Action: registry.RelabelDrop, SourceLabels: []string{"__meta_consul_service_metadata_canary"}, Regex: "true"},
+				{Action: registry.RelabelKeep, SourceLabels: []string{"__meta_consul_service"}, Regex: "web"},
+			},
+			meta: map[string]string{"__meta_consul_service_metadata_canary": "true", "__meta_consul_service": "web"},
+			want: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cr := &consulRegistry{relabelConfigs: compileRelabelConfigs(tt.configs)}
+			if got := cr.relabelDrop(tt.meta); got != tt.want {
+				t.Errorf("relabelDrop() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompileRelabelConfigsSkipsInvalidRegex(t *testing.T) {
+	configs := []registry.RelabelConfig{
+		{Action: registry.RelabelKeep, SourceLabels: []string{"a"}, Regex: "("},
+		{Action: registry.RelabelKeep, SourceLabels: []string{"b"}, Regex: "ok"},
+	}
+
+	compiled := compileRelabelConfigs(configs)
+	if len(compiled) != 1 {
+		t.Fatalf("compileRelabelConfigs() kept %d configs, want 1 (invalid regex should be skipped)", len(compiled))
+	}
+	if compiled[0].sourceLabels[0] != "b" {
+		t.Errorf("compileRelabelConfigs() kept the wrong config: %+v", compiled[0])
+	}
+}
+
+func TestTagSeparator(t *testing.T) {
+	if got := (&consulRegistry{}).tagSeparator(); got != defaultTagSeparator {
+		t.Errorf("tagSeparator() with no override = %q, want %q", got, defaultTagSeparator)
+	}
+	if got := (&consulRegistry{tagSep: "|"}).tagSeparator(); got != "|" {
+		t.Errorf("tagSeparator() with override = %q, want %q", got, "|")
+	}
+}
+
+func TestServiceMeta(t *testing.T) {
+	cr := &consulRegistry{datacenter: "dc1"}
+	service := &consulService{tag: "prod"}
+	service.Name = "web"
+
+	meta := cr.serviceMeta(service)
+	want := map[string]string{
+		"__meta_consul_service":    "web",
+		"__meta_consul_datacenter": "dc1",
+		"__meta_consul_tag":        "prod",
+	}
+	if len(meta) != len(want) {
+		t.Fatalf("serviceMeta() = %v, want %v", meta, want)
+	}
+	for k, v := range want {
+		if meta[k] != v {
+			t.Errorf("serviceMeta()[%q] = %q, want %q", k, meta[k], v)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package consul
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/dffrntmedia/consul-lb-gce/registry"
+
+	"github.com/golang/glog"
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/hashicorp/consul/api/watch"
+	"github.com/hashicorp/go-hclog"
+)
+
+// planWatcher is a watcher backend built on hashicorp/consul/api/watch
+// Plans instead of hand-rolled blocking queries. Plans come with their own
+// backoff, index-reset handling and cancellation, at the cost of depending
+// on the watch package's parameter-map API.
+type planWatcher struct {
+	cr *consulRegistry
+
+	mu    sync.Mutex
+	plans map[serviceKey]*watch.Plan // one "service" plan per watched (name, tag)
+}
+
+func newPlanWatcher(cr *consulRegistry) *planWatcher {
+	return &planWatcher{cr: cr, plans: make(map[serviceKey]*watch.Plan)}
+}
+
+// servicesWatchParams builds the parameter map for a "services" Plan,
+// optionally scoped to tag the same way longPollWatcher scopes its
+// QueryOptions.Filter. NodeMeta has no equivalent in the watch package's
+// "services" type, so newConsulRegistry refuses to build a planWatcher when
+// Config.NodeMeta is set rather than silently ignoring it here.
+func servicesWatchParams(tag string, allowStale bool) map[string]interface{} {
+	params := map[string]interface{}{"type": "services"}
+	if tag != "" {
+		params["filter"] = serviceTagFilter(tag)
+	}
+	if allowStale {
+		params["stale"] = true
+	}
+	return params
+}
+
+func (w *planWatcher) watchServices(ctx context.Context, update chan<- *consulService) {
+	cr := w.cr
+	tags := cr.tagsToWatch
+	if len(tags) == 0 {
+		tags = []string{""}
+	}
+
+	var wg sync.WaitGroup
+	for _, tag := range tags {
+		wg.Add(1)
+		go func(tag string) {
+			defer wg.Done()
+			w.watchServiceSet(ctx, update, tag)
+		}(tag)
+	}
+	wg.Wait()
+}
+
+func (w *planWatcher) watchServiceSet(ctx context.Context, update chan<- *consulService, tag string) {
+	cr := w.cr
+	plan, err := watch.Parse(servicesWatchParams(tag, cr.allowStale))
+	if err != nil {
+		glog.Errorf("Error building services watch plan for tag %q: %s", tag, err)
+		return
+	}
+
+	plan.Handler = func(idx uint64, raw interface{}) {
+		services, ok := raw.(map[string][]string)
+		if !ok {
+			return
+		}
+
+		cr.Lock()
+		defer cr.Unlock()
+
+		for name := range services {
+			key := serviceKey{name: name, tag: tag}
+			if _, ok := cr.watchedServices[key]; ok {
+				continue
+			}
+			service := new(consulService)
+			service.Name = name
+			service.done = make(chan struct{})
+			service.tag = tag
+			cr.watchedServices[key] = service
+			select {
+			case update <- service:
+			case <-ctx.Done():
+			}
+		}
+		for key, srv := range cr.watchedServices {
+			if key.tag != tag {
+				continue
+			}
+			if _, ok := services[key.name]; !ok {
+				srv.removed = true
+				select {
+				case update <- srv:
+				case <-ctx.Done():
+				}
+				delete(cr.watchedServices, key)
+			}
+		}
+	}
+
+	go func() {
+		<-ctx.Done()
+		plan.Stop()
+	}()
+
+	if err := plan.RunWithClientAndHclog(cr.client, hclog.NewNullLogger()); err != nil {
+		glog.Errorf("Services watch plan for tag %q exited: %s", tag, err)
+	}
+}
+
+// serviceWatchParams builds the parameter map for a "service" Plan scoped to
+// a single watched (name, tag) pair. cr.connect has no equivalent here:
+// newConsulRegistry refuses to build a planWatcher with Config.Connect set,
+// since the "service" watch type has no parameter matching Health().Connect.
+func serviceWatchParams(name, tag string, allowStale bool) map[string]interface{} {
+	params := map[string]interface{}{
+		"type":        "service",
+		"service":     name,
+		"passingonly": true,
+	}
+	if tag != "" {
+		params["tag"] = tag
+	}
+	if allowStale {
+		params["stale"] = true
+	}
+	return params
+}
+
+func (w *planWatcher) watchService(ctx context.Context, service *consulService, upstream chan<- *registry.ServiceUpdate) {
+	cr := w.cr
+
+	plan, err := watch.Parse(serviceWatchParams(service.Name, service.tag, cr.allowStale))
+	if err != nil {
+		glog.Errorf("Error building service watch plan for %s: %s", service.Name, err)
+		return
+	}
+
+	key := serviceKey{name: service.Name, tag: service.tag}
+	w.mu.Lock()
+	w.plans[key] = plan
+	w.mu.Unlock()
+
+	plan.Handler = func(idx uint64, raw interface{}) {
+		entries, ok := raw.([]*consulapi.ServiceEntry)
+		if !ok {
+			return
+		}
+
+		instances := make(map[string]*registry.ServiceInstance, len(entries))
+		for _, entry := range entries {
+			node := entry.Service
+			instance := &registry.ServiceInstance{
+				Host:    entry.Node.Node,
+				Address: entry.Node.Address,
+				Tags:    node.Tags,
+				Port:    strconv.Itoa(node.Port),
+				Meta:    cr.instanceMeta(entry),
+			}
+			if node.Proxy != nil {
+				instance.ProxyFor = node.Proxy.DestinationServiceName
+			}
+			if cr.relabelDrop(instance.Meta) {
+				continue
+			}
+			instances[fmt.Sprintf("%s:%d", node.Address, node.Port)] = instance
+		}
+
+		cr.Lock()
+		service.Instances = instances
+		cr.Unlock()
+
+		select {
+		case upstream <- &registry.ServiceUpdate{
+			ServiceName:      service.Name,
+			UpdateType:       registry.CHANGED,
+			ServiceInstances: instances,
+			Tag:              service.tag,
+			Datacenter:       cr.datacenter,
+			Meta:             cr.serviceMeta(service),
+		}:
+		case <-ctx.Done():
+		case <-service.done:
+		}
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-service.done:
+		}
+		plan.Stop()
+		w.mu.Lock()
+		delete(w.plans, key)
+		w.mu.Unlock()
+	}()
+
+	if err := plan.RunWithClientAndHclog(cr.client, hclog.NewNullLogger()); err != nil {
+		glog.Errorf("Service watch plan for %s exited: %s", service.Name, err)
+	}
+}
@@ -0,0 +1,83 @@
+package consul
+
+import "testing"
+
+func TestServicesWatchParams(t *testing.T) {
+	tests := []struct {
+		name       string
+		tag        string
+		allowStale bool
+		want       map[string]interface{}
+	}{
+		{
+			name: "no tag, no stale",
+			want: map[string]interface{}{"type": "services"},
+		},
+		{
+			name: "tag scopes by filter",
+			tag:  "prod",
+			want: map[string]interface{}{"type": "services", "filter": serviceTagFilter("prod")},
+		},
+		{
+			name:       "allowStale sets stale",
+			allowStale: true,
+			want:       map[string]interface{}{"type": "services", "stale": true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := servicesWatchParams(tt.tag, tt.allowStale)
+			if len(got) != len(tt.want) {
+				t.Fatalf("servicesWatchParams() = %v, want %v", got, tt.want)
+			}
+			for k, v := range tt.want {
+				if got[k] != v {
+					t.Errorf("servicesWatchParams()[%q] = %v, want %v", k, got[k], v)
+				}
+			}
+		})
+	}
+}
+
+func TestServiceWatchParams(t *testing.T) {
+	tests := []struct {
+		name       string
+		tag        string
+		allowStale bool
+		want       map[string]interface{}
+	}{
+		{
+			name: "no tag, no stale",
+			want: map[string]interface{}{"type": "service", "service": "web", "passingonly": true},
+		},
+		{
+			name: "tag is passed through so instances are scoped to it",
+			tag:  "prod",
+			want: map[string]interface{}{"type": "service", "service": "web", "passingonly": true, "tag": "prod"},
+		},
+		{
+			name:       "allowStale sets stale",
+			allowStale: true,
+			want:       map[string]interface{}{"type": "service", "service": "web", "passingonly": true, "stale": true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := serviceWatchParams("web", tt.tag, tt.allowStale)
+			if len(got) != len(tt.want) {
+				t.Fatalf("serviceWatchParams() = %v, want %v", got, tt.want)
+			}
+			for k, v := range tt.want {
+				if got[k] != v {
+					t.Errorf("serviceWatchParams()[%q] = %v, want %v", k, got[k], v)
+				}
+			}
+		})
+	}
+
+	if _, ok := serviceWatchParams("web", "", false)["connect"]; ok {
+		t.Error(`serviceWatchParams() must never set "connect": the "service" watch type has no such parameter`)
+	}
+}
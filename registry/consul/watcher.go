@@ -0,0 +1,31 @@
+package consul
+
+import (
+	"context"
+
+	"github.com/dffrntmedia/consul-lb-gce/registry"
+)
+
+// watcher is the pluggable backend a consulRegistry delegates its actual
+// Consul polling to. It owns the two concerns the registry needs watched:
+// the set of services matching tagsToWatch/nodeMeta, and the instances
+// behind each one of them.
+type watcher interface {
+	// watchServices discovers services to watch and reports them (or
+	// their removal) on update, mirroring consulService.removed.
+	watchServices(ctx context.Context, update chan<- *consulService)
+	// watchService streams instance changes for a single service upstream
+	// until ctx is done or service.done is closed.
+	watchService(ctx context.Context, service *consulService, upstream chan<- *registry.ServiceUpdate)
+}
+
+// newWatcher builds the watcher backend selected by kind, defaulting to the
+// hand-rolled long-poll loop this package has always used.
+func newWatcher(kind registry.WatcherKind, cr *consulRegistry) watcher {
+	switch kind {
+	case registry.WatcherKindPlan:
+		return newPlanWatcher(cr)
+	default:
+		return &longPollWatcher{cr: cr}
+	}
+}
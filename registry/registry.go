@@ -0,0 +1,140 @@
+package registry
+
+import (
+	"context"
+	"time"
+)
+
+// UpdateType describes the kind of change a ServiceUpdate carries.
+type UpdateType int
+
+const (
+	// NEW means a service has been discovered and is now being watched.
+	NEW UpdateType = iota
+	// CHANGED means the set of instances behind a service has changed.
+	CHANGED
+	// DELETED means a service is no longer present and should be removed.
+	DELETED
+)
+
+// Config holds the parameters needed to construct a Registry.
+type Config struct {
+	// Addresses is the list of registry endpoints to connect to. More than
+	// one address federates across that pool of endpoints, merging their
+	// service updates into one stream.
+	Addresses []string
+	// Datacenters optionally pins each entry in Addresses to its own
+	// datacenter, by index. A missing or empty entry falls back to
+	// Datacenter. Also applies to a single address.
+	Datacenters []string
+	// TagsToWatch restricts watched services to those carrying at least
+	// one of these tags. When set, the registry watches each tag
+	// independently and reports a service once per matching tag.
+	TagsToWatch []string
+	// NodeMeta restricts watched services to those on nodes carrying all
+	// of these node metadata key/value pairs.
+	NodeMeta map[string]string
+	// AllowStale permits reads from any Consul server, not just the
+	// leader, trading consistency for load distribution.
+	AllowStale bool
+	// Datacenter pins queries to a specific Consul datacenter instead of
+	// the agent's default.
+	Datacenter string
+	// RefreshInterval is the minimum time to wait between watch
+	// iterations, even when Consul's long-poll returns immediately. Zero
+	// disables throttling. Only WatcherKindLongPoll applies it;
+	// WatcherKindPlan does not throttle.
+	RefreshInterval time.Duration
+	// WatcherKind selects the watch backend a Consul-backed Registry uses
+	// internally. The zero value is WatcherKindLongPoll.
+	WatcherKind WatcherKind
+	// Connect, when set, watches Consul Connect-capable proxies instead of
+	// plain service instances, so the GCE load balancer targets sidecar
+	// proxies rather than raw application ports.
+	Connect bool
+	// CAFile, CertFile and KeyFile configure mTLS to Consul. Token is the
+	// ACL token used for every request. Connect deployments universally
+	// require both.
+	CAFile   string
+	CertFile string
+	KeyFile  string
+	Token    string
+	// TagSeparator joins ServiceTags into the __meta_consul_tags label.
+	// Defaults to "," when empty.
+	TagSeparator string
+	// RelabelConfigs filters instances by their Meta labels before they
+	// reach the GCE backend, Prometheus relabel_config-style.
+	RelabelConfigs []RelabelConfig
+}
+
+// RelabelAction is the action a RelabelConfig takes when its regex matches.
+type RelabelAction string
+
+const (
+	// RelabelKeep drops the instance unless the regex matches.
+	RelabelKeep RelabelAction = "keep"
+	// RelabelDrop drops the instance if the regex matches.
+	RelabelDrop RelabelAction = "drop"
+)
+
+// RelabelConfig drops service instances based on their Meta labels, mirroring
+// Prometheus's relabel_config keep/drop actions: SourceLabels are looked up
+// in Meta, joined with ";", and matched in full against Regex.
+type RelabelConfig struct {
+	Action       RelabelAction
+	SourceLabels []string
+	Regex        string
+}
+
+// WatcherKind identifies a watch backend implementation.
+type WatcherKind int
+
+const (
+	// WatcherKindLongPoll is the hand-rolled blocking-query loop.
+	WatcherKindLongPoll WatcherKind = iota
+	// WatcherKindPlan is backed by hashicorp/consul/api/watch Plans.
+	WatcherKindPlan
+)
+
+// ServiceInstance is a single backend instance of a service.
+type ServiceInstance struct {
+	Host    string
+	Address string
+	Tags    []string
+	Port    string
+	// ProxyFor is the destination service name this instance proxies for,
+	// set when the instance is a Consul Connect sidecar proxy rather than
+	// the application itself.
+	ProxyFor string
+	// Meta holds Prometheus-style __meta_consul_* labels describing this
+	// instance: node name, node/service metadata, datacenter and tags.
+	Meta map[string]string
+}
+
+// Service contains data belonging to a single watched service.
+type Service struct {
+	Name      string
+	Instances map[string]*ServiceInstance
+}
+
+// ServiceUpdate is sent upstream whenever a watched service appears,
+// changes or disappears.
+type ServiceUpdate struct {
+	ServiceName      string
+	UpdateType       UpdateType
+	ServiceInstances map[string]*ServiceInstance
+	Tag              string
+	// Datacenter is the datacenter this update was observed in, so GCE
+	// backend groups can be namespaced per datacenter under federation.
+	Datacenter string
+	// Meta holds the service-level subset of __meta_consul_* labels
+	// (service name, datacenter, and the tag it is watched under, if any) shared by every
+	// instance in ServiceInstances.
+	Meta map[string]string
+}
+
+// Registry watches a service discovery backend and streams ServiceUpdates
+// upstream until ctx is done.
+type Registry interface {
+	Run(ctx context.Context, upstream chan<- *ServiceUpdate)
+}